@@ -0,0 +1,140 @@
+package helpers
+
+// Destination address selection as specified in RFC 6724, used to order the
+// merged A/AAAA answers so that callers dialing the first address get
+// Happy-Eyeballs-friendly behaviour (scope and label matching the first
+// address preferred, so that address's family generally stays in front, then
+// higher precedence, longest common prefix as a tie-breaker).
+
+import (
+	"net"
+	"sort"
+)
+
+type ipAttr struct {
+	ip        net.IP
+	scope     uint8
+	precedent uint8
+	label     uint8
+}
+
+// RFC 6724 section 2.1: precedence table.
+var policyTable = []struct {
+	prefix    string
+	precedent uint8
+	label     uint8
+}{
+	{"::1/128", 50, 0},
+	{"::/0", 40, 1},
+	{"::ffff:0:0/96", 35, 4},
+	{"2002::/16", 30, 2},
+	{"2001::/32", 5, 5},
+	{"fc00::/7", 3, 13},
+	{"::/96", 1, 3},
+	{"fec0::/10", 1, 11},
+	{"3ffe::/16", 1, 12},
+}
+
+var policyTablePrefixes []*net.IPNet
+
+func init() {
+	policyTablePrefixes = make([]*net.IPNet, len(policyTable))
+	for i, e := range policyTable {
+		_, n, err := net.ParseCIDR(e.prefix)
+		if err != nil {
+			panic(err)
+		}
+		policyTablePrefixes[i] = n
+	}
+}
+
+func classify(ip net.IP) (precedent, label uint8) {
+	precedent, label = 1, 1
+	best := -1
+	for i, n := range policyTablePrefixes {
+		if ones, _ := n.Mask.Size(); ones > best && n.Contains(ip) {
+			best = ones
+			precedent, label = policyTable[i].precedent, policyTable[i].label
+		}
+	}
+	return precedent, label
+}
+
+func addrScope(ip net.IP) uint8 {
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4.IsLoopback() || ip4.IsLinkLocalUnicast() {
+			return 2 // link-local
+		}
+		return 14 // global
+	}
+	switch {
+	case ip.IsLoopback():
+		return 2
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return 2
+	case ip.IsInterfaceLocalMulticast():
+		return 1
+	default:
+		return 14
+	}
+}
+
+func commonPrefixLen(a, b net.IP) int {
+	a16, b16 := a.To16(), b.To16()
+	if a16 == nil || b16 == nil {
+		return 0
+	}
+	n := 0
+	for i := 0; i < len(a16); i++ {
+		x := a16[i] ^ b16[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// sortByRFC6724 reorders addrs in place, preferring (in order): matching
+// scope, matching label, higher precedence and finally longer common
+// prefix length with the first address of the set (used as a cheap stand-in
+// for "preferred source address" since we have no route table to consult).
+func sortByRFC6724(addrs []net.IP) {
+	if len(addrs) < 2 {
+		return
+	}
+
+	attrs := make([]ipAttr, len(addrs))
+	for i, ip := range addrs {
+		p, l := classify(ip)
+		attrs[i] = ipAttr{ip: ip, scope: addrScope(ip), precedent: p, label: l}
+	}
+
+	dstScope := attrs[0].scope
+	dstLabel := attrs[0].label
+	ref := attrs[0].ip
+
+	sort.SliceStable(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+
+		if (a.scope == dstScope) != (b.scope == dstScope) {
+			return a.scope == dstScope
+		}
+		if (a.label == dstLabel) != (b.label == dstLabel) {
+			return a.label == dstLabel
+		}
+		if a.precedent != b.precedent {
+			return a.precedent > b.precedent
+		}
+		return commonPrefixLen(a.ip, ref) > commonPrefixLen(b.ip, ref)
+	})
+
+	for i, a := range attrs {
+		addrs[i] = a.ip
+	}
+}
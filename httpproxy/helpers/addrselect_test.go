@@ -0,0 +1,73 @@
+package helpers
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSortByRFC6724(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "ipv6 preferred over ipv4 when first address is ipv6",
+			in:   []string{"2001:4860:4860::8888", "8.8.8.8"},
+			want: []string{"2001:4860:4860::8888", "8.8.8.8"},
+		},
+		{
+			name: "ipv4 preferred over ipv6 when first address is ipv4",
+			in:   []string{"8.8.8.8", "2001:4860:4860::8888"},
+			want: []string{"8.8.8.8", "2001:4860:4860::8888"},
+		},
+		{
+			name: "longer common prefix with the reference address sorts first",
+			in:   []string{"203.0.113.1", "198.51.100.1", "203.0.113.200"},
+			want: []string{"203.0.113.1", "203.0.113.200", "198.51.100.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := make([]net.IP, len(tt.in))
+			for i, s := range tt.in {
+				addrs[i] = net.ParseIP(s)
+			}
+
+			sortByRFC6724(addrs)
+
+			got := make([]string, len(addrs))
+			for i, ip := range addrs {
+				got[i] = ip.String()
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("sortByRFC6724(%v) = %v, want %v", tt.in, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestSortByRFC6724ReferenceIsStable checks that sorting is idempotent:
+// re-sorting an already-sorted slice, whose later entries tie with each
+// other on every rule, must not reorder it any further.
+func TestSortByRFC6724ReferenceIsStable(t *testing.T) {
+	in := []string{"203.0.113.1", "198.51.100.9", "198.51.100.1", "198.51.100.200"}
+	addrs := make([]net.IP, len(in))
+	for i, s := range in {
+		addrs[i] = net.ParseIP(s)
+	}
+
+	sortByRFC6724(addrs)
+	first := make([]net.IP, len(addrs))
+	copy(first, addrs)
+
+	sortByRFC6724(addrs)
+	for i := range addrs {
+		if !addrs[i].Equal(first[i]) {
+			t.Fatalf("sorting an already-sorted slice changed the order: got %v, want %v", addrs, first)
+		}
+	}
+}
@@ -1,18 +1,27 @@
 package helpers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/MeABc/glog"
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 )
 
+// DialFunc is the signature Resolver.Dial must implement, mirroring
+// net.Resolver.Dial. It lets callers tunnel DNS queries through an existing
+// proxy, pin the source address per upstream, or serve canned responses in
+// tests.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
 const (
 	DefaultDNSCacheExpiry time.Duration = 600 * time.Second
 )
@@ -24,7 +33,159 @@ type Resolver struct {
 	DNSExpiry   time.Duration
 	DisableIPv6 bool
 	ForceIPv6   bool
-	network     string // name of the network (for example, "tcp", "udp")
+	// StrictErrors mirrors net.Resolver.StrictErrors: when true, an error
+	// looking up either the A or AAAA record aborts LookupIP with that
+	// error (a name that simply has no records of one family is not such an
+	// error); when false (the default), the other family's addresses are
+	// still returned if at least one query succeeded.
+	StrictErrors bool
+	// EnableDNSSEC sets the EDNS(0) DO bit on outgoing queries, asking
+	// upstream servers to return RRSIG/DNSKEY records alongside answers.
+	EnableDNSSEC bool
+	// Dial, if non-nil, is used to establish every upstream connection
+	// (UDP, TCP, DoT and DoH) instead of the default dialer, so it also
+	// receives ctx cancellation from LookupIPContext.
+	Dial DialFunc
+	// RefreshAhead, when positive, triggers a background singleflighted
+	// refresh of a cached name once its remaining TTL drops below this
+	// threshold, so hot names are kept warm instead of stalling the next
+	// caller with a synchronous miss.
+	RefreshAhead time.Duration
+	network      string // name of the network (for example, "tcp", "udp")
+
+	upstreamOnce sync.Once
+	upstream     Upstream
+	upstreamErr  error
+
+	tcpUpstreamOnce sync.Once
+	tcpUpstream     Upstream
+	tcpUpstreamErr  error
+
+	sfGroup singleflight.Group
+}
+
+// getUpstream lazily builds and caches the Upstream for r.DNSServer, parsing
+// its scheme (udp://, tcp://, tls://, https://) on first use.
+func (r *Resolver) getUpstream() (Upstream, error) {
+	r.upstreamOnce.Do(func() {
+		r.upstream, r.upstreamErr = NewUpstream(r.DNSServer, r.Dial)
+	})
+	return r.upstream, r.upstreamErr
+}
+
+// getTCPUpstream lazily builds a TCP upstream to the same DNS server, used
+// to retry queries whose UDP reply came back truncated.
+func (r *Resolver) getTCPUpstream() (Upstream, error) {
+	r.tcpUpstreamOnce.Do(func() {
+		r.tcpUpstream, r.tcpUpstreamErr = newTCPUpstream(upstreamHost(r.DNSServer), r.Dial)
+	})
+	return r.tcpUpstream, r.tcpUpstreamErr
+}
+
+// cachedAnswer is the LRUCache value type exchangeType uses to negative-
+// cache NXDOMAIN/no-records answers per (name, qtype), so a cache hit can
+// reproduce the original error without re-querying the upstream until the
+// cached TTL expires. This is the only negative-cache layer: the outer,
+// bare-name cache in resolveAndCache stores positive answers exclusively.
+type cachedAnswer struct {
+	ips []net.IP
+	err error
+}
+
+// notFoundError records a negative DNS answer together with how long it may
+// be cached for, per the authority section's SOA minimum TTL.
+type notFoundError struct {
+	name  string
+	qtype uint16
+	ttl   time.Duration
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("helpers: no such record for %#v (qtype %d)", e.name, e.qtype)
+}
+
+// cacheState distinguishes the three outcomes of looking a name up in
+// r.LRUCache: missing entirely, present and within its TTL, or present but
+// past its TTL (still serveable as a staleIfError fallback).
+type cacheState int
+
+const (
+	cacheAbsent cacheState = iota
+	cacheFresh
+	cacheStale
+)
+
+// cacheEntry is the LRUCache value type LookupIP stores for a resolved
+// name. lrucache.Cache has no way to recover a key's expiry once stored, so
+// expiresAt is carried in the value itself; cacheLookup and the RefreshAhead
+// check both read it back from here rather than from the cache.
+type cacheEntry struct {
+	ips       []net.IP
+	expiresAt time.Time
+}
+
+// cacheLookup reports whether name is cached and, if so, whether that entry
+// is still within its TTL. GetNotStale cannot be used for this: it evicts
+// whatever it finds past its TTL before reporting the miss, so a fallback
+// Get would never see a stale entry to serve. Instead, look the key up once
+// with the side-effect-free Get and classify fresh vs. stale ourselves from
+// the expiresAt already carried in the cached value. A value that carries no
+// expiresAt (a bare []net.IP or a string alias) is classified by
+// GetNotStale instead, the only view of the cache's own expiry for it.
+func (r *Resolver) cacheLookup(key string) (interface{}, cacheState) {
+	v, ok := r.LRUCache.Get(key)
+	if !ok {
+		return nil, cacheAbsent
+	}
+	_, expiresAt, decOK := decodeCacheValue(v)
+	if !decOK || expiresAt.IsZero() {
+		if _, notStale := r.LRUCache.GetNotStale(key); !notStale {
+			return v, cacheStale
+		}
+		return v, cacheFresh
+	}
+	if !time.Now().Before(expiresAt) {
+		return v, cacheStale
+	}
+	return v, cacheFresh
+}
+
+// decodeCacheValue converts a raw LRUCache value for LookupIP into its
+// ([]net.IP, expiresAt) result, reporting whether v was a recognized type.
+// Only positive answers are ever stored under the bare name key (see
+// resolveAndCache), so there is no error to recover here. A bare []net.IP
+// (as may be set by code outside this package) is accepted for backward
+// compatibility but carries no expiresAt, so RefreshAhead is simply skipped
+// for it.
+func decodeCacheValue(v interface{}) (ips []net.IP, expiresAt time.Time, ok bool) {
+	switch vv := v.(type) {
+	case cacheEntry:
+		return vv.ips, vv.expiresAt, true
+	case []net.IP:
+		return vv, time.Time{}, true
+	default:
+		return nil, time.Time{}, false
+	}
+}
+
+// negativeTTL returns the TTL to honor for a negative answer, following the
+// SOA minimum TTL from the authority section (RFC 2308), clamped to
+// maxTTL when maxTTL is positive.
+func negativeTTL(reply *dns.Msg, maxTTL time.Duration) time.Duration {
+	ttl := DefaultDNSCacheExpiry
+	for _, rr := range reply.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = time.Duration(soa.Minttl) * time.Second
+			if hdrTTL := time.Duration(soa.Hdr.Ttl) * time.Second; hdrTTL < ttl {
+				ttl = hdrTTL
+			}
+			break
+		}
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
 }
 
 func (r *Resolver) LookupHost(name string) ([]string, error) {
@@ -42,16 +203,38 @@ func (r *Resolver) LookupHost(name string) ([]string, error) {
 }
 
 func (r *Resolver) LookupIP(name string) ([]net.IP, error) {
+	return r.LookupIPContext(context.Background(), name)
+}
+
+// LookupIPContext is LookupIP with an explicit context.Context, so
+// cancellation and deadlines reach Resolver.Dial.
+func (r *Resolver) LookupIPContext(ctx context.Context, name string) ([]net.IP, error) {
 	if r.LRUCache != nil {
-		if v, ok := r.LRUCache.GetNotStale(name); ok {
-			switch v.(type) {
-			case []net.IP:
-				return v.([]net.IP), nil
-			case string:
-				return r.LookupIP(v.(string))
-			default:
+		if v, state := r.cacheLookup(name); state != cacheAbsent {
+			if alias, ok := v.(string); ok {
+				return r.LookupIPContext(ctx, alias)
+			}
+
+			ips, expiresAt, ok := decodeCacheValue(v)
+			if !ok {
 				return nil, fmt.Errorf("LookupIP: cannot convert %T(%+v) to []net.IP", v, v)
 			}
+
+			if state == cacheFresh {
+				if r.RefreshAhead > 0 && !expiresAt.IsZero() && time.Until(expiresAt) < r.RefreshAhead {
+					go r.refresh(context.Background(), name)
+				}
+				return ips, nil
+			}
+
+			// Stale: refresh synchronously (singleflighted), but fall back
+			// to the last-known answer if the refresh itself fails
+			// (staleIfError) rather than turning a stale hit into an error.
+			freshIPs, freshErr := r.refresh(ctx, name)
+			if freshErr != nil {
+				return ips, nil
+			}
+			return freshIPs, freshErr
 		}
 	}
 
@@ -59,12 +242,52 @@ func (r *Resolver) LookupIP(name string) ([]net.IP, error) {
 		return []net.IP{ip}, nil
 	}
 
+	return r.refresh(ctx, name)
+}
+
+// refresh resolves name against upstream (or the system resolver) and
+// updates r.LRUCache, coalescing concurrent callers for the same name and
+// IP family with sfGroup so a TTL expiry under load triggers one query
+// instead of a stampede.
+func (r *Resolver) refresh(ctx context.Context, name string) ([]net.IP, error) {
+	v, err, _ := r.sfGroup.Do(r.singleflightKey(name), func() (interface{}, error) {
+		return r.resolveAndCache(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]net.IP), nil
+}
+
+// singleflightKey incorporates the IP family into the coalescing key so a
+// ForceIPv6/DisableIPv6 lookup never shares a result with the default
+// dual-stack lookup for the same name.
+func (r *Resolver) singleflightKey(name string) string {
+	switch {
+	case r.ForceIPv6:
+		return name + "#6"
+	case r.DisableIPv6:
+		return name + "#4"
+	default:
+		return name + "#*"
+	}
+}
+
+// resolveAndCache performs the actual upstream (or system resolver) lookup
+// for name and stores a positive result in r.LRUCache; it does not itself
+// consult the cache. Negative (NXDOMAIN / no records) answers are not
+// cached here: they are already cached per (name, qtype) by exchangeType,
+// and caching them again under the bare name would conflate IP families —
+// a ForceIPv6/DisableIPv6 Resolver hitting NXDOMAIN for its single queried
+// family must not poison a later dual-stack or opposite-family lookup that
+// shares the same LRUCache.
+func (r *Resolver) resolveAndCache(ctx context.Context, name string) ([]net.IP, error) {
 	lookupIP := r.lookupIP1
 	if r.DNSServer != "" {
 		lookupIP = r.lookupIP2
 	}
 
-	ips, err := lookupIP(name)
+	ips, err := lookupIP(ctx, name)
 	if err == nil {
 		if r.BlackList != nil {
 			ips1 := ips[:0]
@@ -77,11 +300,12 @@ func (r *Resolver) LookupIP(name string) ([]net.IP, error) {
 		}
 
 		if r.LRUCache != nil && len(ips) > 0 {
-			if r.DNSExpiry == 0 {
-				r.LRUCache.Set(name, ips, time.Now().Add(DefaultDNSCacheExpiry))
-			} else {
-				r.LRUCache.Set(name, ips, time.Now().Add(r.DNSExpiry))
+			expiry := r.DNSExpiry
+			if expiry == 0 {
+				expiry = DefaultDNSCacheExpiry
 			}
+			expiresAt := time.Now().Add(expiry)
+			r.LRUCache.Set(name, cacheEntry{ips: ips, expiresAt: expiresAt}, expiresAt)
 		}
 	}
 
@@ -89,10 +313,31 @@ func (r *Resolver) LookupIP(name string) ([]net.IP, error) {
 	return ips, err
 }
 
-func (r *Resolver) lookupIP1(name string) ([]net.IP, error) {
-	ips, err := LookupIP(name)
-	if err != nil {
-		return nil, err
+// lookupIP1 resolves name via the system resolver (LookupIP). That call has
+// no context of its own, so it runs on a separate goroutine: a canceled or
+// expired ctx unblocks the caller immediately, though the system lookup
+// itself keeps running in the background until it returns.
+func (r *Resolver) lookupIP1(ctx context.Context, name string) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		ips, err := LookupIP(name)
+		ch <- result{ips, err}
+	}()
+
+	var ips []net.IP
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.err != nil {
+			return nil, res.err
+		}
+		ips = res.ips
 	}
 
 	ips1 := ips[:0]
@@ -108,39 +353,63 @@ func (r *Resolver) lookupIP1(name string) ([]net.IP, error) {
 		}
 	}
 
+	sortByRFC6724(ips1)
 	return ips1, nil
 }
 
-func (r *Resolver) lookupIP2(name string) ([]net.IP, error) {
-	c := &dns.Client{
-		Timeout: 5 * time.Second,
+// exchangeType resolves a single qtype (dns.TypeA or dns.TypeAAAA) against
+// r.DNSServer, retrying over TCP when the UDP reply is truncated, and
+// negative-caches NXDOMAIN/empty answers keyed by (name, qtype) honoring
+// the authority section's SOA minimum TTL.
+func (r *Resolver) exchangeType(ctx context.Context, name string, qtype uint16) ([]net.IP, error) {
+	negKey := fmt.Sprintf("%s#%d", name, qtype)
+	if r.LRUCache != nil {
+		if v, ok := r.LRUCache.GetNotStale(negKey); ok {
+			if ca, ok := v.(cachedAnswer); ok {
+				return ca.ips, ca.err
+			}
+		}
 	}
+
 	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, r.EnableDNSSEC)
 
-	switch {
-	case r.ForceIPv6:
-		m.SetQuestion(dns.Fqdn(name), dns.TypeAAAA)
-	case r.DisableIPv6:
-		m.SetQuestion(dns.Fqdn(name), dns.TypeA)
-	default:
-		m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	upstream, err := r.getUpstream()
+	if err != nil {
+		return nil, err
 	}
 
-	ip0, port0, _, err := ParseIPPort(r.DNSServer)
+	reply, err := upstream.Exchange(ctx, m)
 	if err != nil {
 		return nil, err
 	}
-	if port0 == "" {
-		port0 = "53"
+
+	if reply.Truncated {
+		tcpUpstream, err := r.getTCPUpstream()
+		if err != nil {
+			return nil, err
+		}
+		reply, err = tcpUpstream.Exchange(ctx, m)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	reply, _, err := c.Exchange(m, net.JoinHostPort(ip0.String(), "53"))
-	if err != nil {
-		return nil, err
+	if reply.IsEdns0() == nil {
+		glog.V(2).Infof("exchangeType(%#v, %d): dns server %v did not echo the EDNS(0) OPT record", name, qtype, r.DNSServer)
 	}
 
-	if len(reply.Answer) < 1 {
-		return nil, fmt.Errorf("no Answer from dns server %v", r.DNSServer)
+	if reply.Rcode == dns.RcodeNameError || (reply.Rcode == dns.RcodeSuccess && len(reply.Answer) == 0) {
+		nf := &notFoundError{name: name, qtype: qtype, ttl: negativeTTL(reply, r.DNSExpiry)}
+		if r.LRUCache != nil {
+			r.LRUCache.Set(negKey, cachedAnswer{err: nf}, time.Now().Add(nf.ttl))
+		}
+		return nil, nf
+	}
+
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("helpers: dns server %v answered %#v (qtype %d) with %s", r.DNSServer, name, qtype, dns.RcodeToString[reply.Rcode])
 	}
 
 	ips := make([]net.IP, 0, 4)
@@ -161,6 +430,61 @@ func (r *Resolver) lookupIP2(name string) ([]net.IP, error) {
 	return ips, nil
 }
 
+type lookupResult struct {
+	ips []net.IP
+	err error
+}
+
+// lookupIP2 issues A and AAAA queries against r.DNSServer concurrently
+// (unless the resolver is pinned to a single family via DisableIPv6 /
+// ForceIPv6), merges the answers and orders them with sortByRFC6724 for
+// Happy-Eyeballs-friendly dialing.
+func (r *Resolver) lookupIP2(ctx context.Context, name string) ([]net.IP, error) {
+	switch {
+	case r.ForceIPv6:
+		return r.exchangeType(ctx, name, dns.TypeAAAA)
+	case r.DisableIPv6:
+		return r.exchangeType(ctx, name, dns.TypeA)
+	}
+
+	aCh := make(chan lookupResult, 1)
+	aaaaCh := make(chan lookupResult, 1)
+
+	go func() {
+		ips, err := r.exchangeType(ctx, name, dns.TypeA)
+		aCh <- lookupResult{ips, err}
+	}()
+	go func() {
+		ips, err := r.exchangeType(ctx, name, dns.TypeAAAA)
+		aaaaCh <- lookupResult{ips, err}
+	}()
+
+	a, aaaa := <-aCh, <-aaaaCh
+
+	if r.StrictErrors {
+		for _, err := range []error{a.err, aaaa.err} {
+			if _, notFound := err.(*notFoundError); err != nil && !notFound {
+				return nil, err
+			}
+		}
+	}
+
+	if a.err != nil && aaaa.err != nil {
+		return nil, a.err
+	}
+
+	ips := make([]net.IP, 0, len(a.ips)+len(aaaa.ips))
+	ips = append(ips, a.ips...)
+	ips = append(ips, aaaa.ips...)
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no Answer from dns server %v", r.DNSServer)
+	}
+
+	sortByRFC6724(ips)
+	return ips, nil
+}
+
 // https://rosettacode.org/wiki/Parse_an_IP_Address#Go
 func ParseIPPort(s string) (ip net.IP, port, space string, err error) {
 	ip = net.ParseIP(s)
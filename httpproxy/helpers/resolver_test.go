@@ -0,0 +1,64 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func soaReply(minttl, hdrTTL uint32) *dns.Msg {
+	reply := &dns.Msg{}
+	reply.Ns = []dns.RR{
+		&dns.SOA{
+			Hdr:    dns.RR_Header{Ttl: hdrTTL},
+			Minttl: minttl,
+		},
+	}
+	return reply
+}
+
+func TestNegativeTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  *dns.Msg
+		maxTTL time.Duration
+		want   time.Duration
+	}{
+		{
+			name:  "no SOA falls back to the default expiry",
+			reply: &dns.Msg{},
+			want:  DefaultDNSCacheExpiry,
+		},
+		{
+			name:  "SOA minimum TTL is honored",
+			reply: soaReply(60, 3600),
+			want:  60 * time.Second,
+		},
+		{
+			name:  "header TTL caps the SOA minimum when lower",
+			reply: soaReply(3600, 60),
+			want:  60 * time.Second,
+		},
+		{
+			name:   "maxTTL clamps a larger SOA minimum",
+			reply:  soaReply(3600, 3600),
+			maxTTL: 30 * time.Second,
+			want:   30 * time.Second,
+		},
+		{
+			name:   "maxTTL does not extend a smaller SOA minimum",
+			reply:  soaReply(10, 10),
+			maxTTL: 30 * time.Second,
+			want:   10 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negativeTTL(tt.reply, tt.maxTTL); got != tt.want {
+				t.Fatalf("negativeTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
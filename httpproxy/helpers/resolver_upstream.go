@@ -0,0 +1,333 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream abstracts a single DNS transport (plain UDP/TCP, DNS-over-TLS or
+// DNS-over-HTTPS) so that Resolver can treat them uniformly.
+type Upstream interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// NewUpstream parses server and returns the Upstream it names. The scheme
+// selects the transport:
+//
+//	udp://1.1.1.1:53   (default when no scheme is given)
+//	tcp://1.1.1.1:53
+//	tls://1.1.1.1:853  (DNS-over-TLS, RFC 7858)
+//	https://1.1.1.1/dns-query (DNS-over-HTTPS, RFC 8484)
+//
+// dial, when non-nil, is used to establish the upstream's connection(s)
+// instead of the default dialer (see Resolver.Dial).
+func NewUpstream(server string, dial DialFunc) (Upstream, error) {
+	scheme, host := "udp", server
+
+	if u, err := url.Parse(server); err == nil && u.Scheme != "" && u.Host != "" {
+		scheme, host = u.Scheme, u.Host
+	}
+
+	switch scheme {
+	case "udp":
+		return newUDPUpstream(host, dial)
+	case "tcp":
+		return newTCPUpstream(host, dial)
+	case "tls", "dot":
+		return newDoTUpstream(host, dial)
+	case "https", "doh":
+		return newDoHUpstream(server, dial)
+	default:
+		return nil, fmt.Errorf("helpers: unsupported DNS upstream scheme %#v in %#v", scheme, server)
+	}
+}
+
+// upstreamHost strips the scheme from server, leaving a bare host[:port]
+// suitable for building a same-host upstream on a different transport (for
+// example, retrying a truncated UDP reply over TCP).
+func upstreamHost(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Host
+	}
+	return server
+}
+
+func withDefaultPort(host, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("helpers: invalid DNS upstream address %#v", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// dialNetConn dials network/addr using dial if set, falling back to a plain
+// net.Dialer so upstreams behave identically when Resolver.Dial is nil.
+func dialNetConn(ctx context.Context, dial DialFunc, network, addr string) (net.Conn, error) {
+	if dial != nil {
+		return dial(ctx, network, addr)
+	}
+	return (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, addr)
+}
+
+type udpUpstream struct {
+	addr string
+	dial DialFunc
+}
+
+func newUDPUpstream(host string, dial DialFunc) (Upstream, error) {
+	addr, err := withDefaultPort(host, "53")
+	if err != nil {
+		return nil, err
+	}
+	return &udpUpstream{addr: addr, dial: dial}, nil
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	conn, err := dialNetConn(ctx, u.dial, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	dnsConn := &dns.Conn{Conn: conn}
+	if err := dnsConn.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	reply, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if reply.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return reply, nil
+}
+
+type tcpUpstream struct {
+	addr string
+	dial DialFunc
+}
+
+func newTCPUpstream(host string, dial DialFunc) (Upstream, error) {
+	addr, err := withDefaultPort(host, "53")
+	if err != nil {
+		return nil, err
+	}
+	return &tcpUpstream{addr: addr, dial: dial}, nil
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	conn, err := dialNetConn(ctx, u.dial, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	dnsConn := &dns.Conn{Conn: conn}
+	if err := dnsConn.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	reply, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if reply.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return reply, nil
+}
+
+// dotUpstream speaks DNS-over-TLS (RFC 7858) over a single persistent
+// *dns.Conn, reconnecting whenever the connection is idle too long or the
+// peer closes it. ioMu serializes Exchange calls one at a time: the
+// connection has no way to demultiplex replies by query ID, so two
+// Exchanges sharing it concurrently could each read the other's reply off
+// the wire.
+type dotUpstream struct {
+	addr        string
+	tlsConfig   *tls.Config
+	idleTimeout time.Duration
+	dial        DialFunc
+
+	mu       sync.Mutex
+	conn     *dns.Conn
+	lastUsed time.Time
+
+	ioMu sync.Mutex
+}
+
+func newDoTUpstream(host string, dial DialFunc) (Upstream, error) {
+	addr, err := withDefaultPort(host, "853")
+	if err != nil {
+		return nil, err
+	}
+	serverName, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dotUpstream{
+		addr:        addr,
+		tlsConfig:   &tls.Config{ServerName: serverName},
+		idleTimeout: 30 * time.Second,
+		dial:        dial,
+	}, nil
+}
+
+func (u *dotUpstream) getConn(ctx context.Context) (*dns.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil && time.Since(u.lastUsed) < u.idleTimeout {
+		return u.conn, nil
+	}
+
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+
+	rawConn, err := dialNetConn(ctx, u.dial, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(rawConn, u.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	u.conn = &dns.Conn{Conn: tlsConn}
+	return u.conn, nil
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.ioMu.Lock()
+	defer u.ioMu.Unlock()
+
+	conn, err := u.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	if err := conn.WriteMsg(m); err != nil {
+		u.mu.Lock()
+		if u.conn == conn {
+			conn.Close()
+			u.conn = nil
+		}
+		u.mu.Unlock()
+		return nil, err
+	}
+
+	reply, err := conn.ReadMsg()
+	if err != nil {
+		u.mu.Lock()
+		if u.conn == conn {
+			conn.Close()
+			u.conn = nil
+		}
+		u.mu.Unlock()
+		return nil, err
+	}
+	if reply.Id != m.Id {
+		return nil, dns.ErrId
+	}
+
+	u.mu.Lock()
+	u.lastUsed = time.Now()
+	u.mu.Unlock()
+
+	return reply, nil
+}
+
+// dohUpstream speaks DNS-over-HTTPS (RFC 8484) using the wire format over a
+// POST request, reusing one *http.Client (and its HTTP/2 connection pool)
+// across queries.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(rawurl string, dial DialFunc) (Upstream, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	if dial != nil {
+		client.Transport = &http.Transport{
+			ForceAttemptHTTP2: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+	}
+	return &dohUpstream{url: rawurl, client: client}, nil
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("helpers: DoH upstream %#v returned status %s", u.url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &dns.Msg{}
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	if reply.Id != m.Id {
+		return nil, dns.ErrId
+	}
+
+	return reply, nil
+}
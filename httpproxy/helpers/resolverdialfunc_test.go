@@ -0,0 +1,66 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDNSServer answers every query on conn with a canned A record for the
+// question's name, letting tests exercise Resolver.Dial without touching a
+// real network.
+func fakeDNSServer(t *testing.T, conn net.Conn) {
+	t.Helper()
+	dnsConn := &dns.Conn{Conn: conn}
+	defer dnsConn.Close()
+
+	req, err := dnsConn.ReadMsg()
+	if err != nil {
+		t.Errorf("fakeDNSServer: ReadMsg: %v", err)
+		return
+	}
+
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("203.0.113.42").To4(),
+		},
+	}
+
+	if err := dnsConn.WriteMsg(reply); err != nil {
+		t.Errorf("fakeDNSServer: WriteMsg: %v", err)
+	}
+}
+
+// TestResolverDialFunc verifies that Resolver.Dial, when set, is used to
+// establish the upstream connection instead of a real dialer, so callers can
+// inject fake connections serving canned responses (as with
+// net.Resolver.Dial).
+func TestResolverDialFunc(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeDNSServer(t, server)
+
+	var dialed bool
+	r := &Resolver{
+		DNSServer: "udp://192.0.2.53:53",
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = true
+			return client, nil
+		},
+	}
+
+	ips, err := r.exchangeType(context.Background(), "example.com.", dns.TypeA)
+	if err != nil {
+		t.Fatalf("exchangeType() error = %v", err)
+	}
+	if !dialed {
+		t.Fatal("exchangeType() did not use Resolver.Dial to establish the connection")
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("203.0.113.42")) {
+		t.Fatalf("exchangeType() ips = %v, want [203.0.113.42]", ips)
+	}
+}